@@ -0,0 +1,232 @@
+// Copyright 2014-2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// cniEnvVars are the environment variables the CNI spec requires a runtime
+// to set before invoking a plugin. ClientMain reads these from its own
+// environment and forwards them to the daemon, which replays them through
+// the Getenv hook pluginMain already expects.
+var cniEnvVars = []string{
+	"CNI_COMMAND",
+	"CNI_CONTAINERID",
+	"CNI_NETNS",
+	"CNI_IFNAME",
+	"CNI_ARGS",
+	"CNI_PATH",
+}
+
+// daemonRequest is the message ClientMain sends to PluginMainServe over the
+// Unix socket: the CNI env vars plus the bytes the runtime would otherwise
+// pipe to the plugin's stdin.
+type daemonRequest struct {
+	Env       map[string]string
+	StdinData []byte
+}
+
+// daemonResponse is the reply PluginMainServe sends back: everything the
+// shim binary needs to reproduce what a standalone plugin process would
+// have written to stdout/stderr, and the code it would have exited with.
+type daemonResponse struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// PluginMainServe runs a long-lived CNI plugin daemon that accepts
+// invocations on a Unix socket at socketPath instead of being re-executed by
+// the runtime for every ADD/CHECK/DEL. This follows the pattern used by
+// projects like kuryr-cni: a tiny shim binary (see ClientMain) forwards each
+// invocation to this persistent process over the socket, so expensive
+// one-time setup (IPAM stores, netlink handles, ...) is paid once instead of
+// on every invocation.
+//
+// PluginMainServe serves connections until ctx is canceled, at which point
+// it closes the listener and returns nil.
+func PluginMainServe(ctx context.Context, socketPath string, cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) error {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return fmt.Errorf("failed to remove existing socket %q: %v", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+	}
+
+	// CNI_LOG_FILE/CNI_LOG_LEVEL are read once here, from the daemon's own
+	// environment, rather than per forwarded invocation: the daemon is
+	// configured for logging once at startup. Opening the log file once and
+	// closing it on shutdown, instead of on every connection, avoids
+	// leaking a file descriptor per invocation.
+	logger := newLoggerFromEnv(os.Getenv)
+	if closer, ok := logger.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveDaemonConn(conn, cmdAdd, cmdCheck, cmdDel, versionInfo, logger)
+	}
+}
+
+// stdoutRedirectMu serializes access to the process-wide os.Stdout redirect
+// captureStdout performs. A plugin's ADD/CHECK result is emitted by its
+// callback via types.PrintResult, which always writes to the real
+// os.Stdout rather than to the dispatcher's Stdout field, so daemon
+// invocations must take turns owning os.Stdout rather than running
+// concurrently.
+var stdoutRedirectMu sync.Mutex
+
+// captureStdout temporarily redirects the process's os.Stdout to an
+// in-memory pipe, so that a single invocation's plugin output can be
+// collected per-connection instead of going to the daemon process's own
+// stdout. The caller must hold stdoutRedirectMu for the duration between
+// calling captureStdout and calling the returned restore func.
+func captureStdout() (collect func() []byte, restore func(), err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	realStdout := os.Stdout
+	os.Stdout = w
+
+	buf := &bytes.Buffer{}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(buf, r)
+		close(done)
+	}()
+
+	collect = func() []byte { return buf.Bytes() }
+	restore = func() {
+		os.Stdout = realStdout
+		w.Close()
+		<-done
+		r.Close()
+	}
+	return collect, restore, nil
+}
+
+func serveDaemonConn(conn net.Conn, cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, logger Logger) {
+	defer conn.Close()
+
+	var req daemonRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	stderr := &bytes.Buffer{}
+	t := &dispatcher{
+		Getenv: func(key string) string { return req.Env[key] },
+		Stdin:  bytes.NewReader(req.StdinData),
+		Stderr: stderr,
+		Logger: logger,
+	}
+
+	stdoutRedirectMu.Lock()
+	collect, restore, err := captureStdout()
+	if err != nil {
+		stdoutRedirectMu.Unlock()
+		fmt.Fprintf(stderr, "error capturing plugin stdout: %v\n", err)
+		json.NewEncoder(conn).Encode(&daemonResponse{ExitCode: 1, Stderr: stderr.Bytes()})
+		return
+	}
+	t.Stdout = os.Stdout
+
+	e := t.pluginMain(cmdAdd, nil, cmdCheck, cmdDel, versionInfo)
+	restore()
+	stdoutRedirectMu.Unlock()
+
+	resp := daemonResponse{Stdout: collect()}
+	if e != nil {
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(e); err != nil {
+			fmt.Fprintf(stderr, "error writing error JSON to stdout: %v\n", err)
+		}
+		resp.Stdout = buf.Bytes()
+		resp.ExitCode = 1
+	}
+	resp.Stderr = stderr.Bytes()
+
+	json.NewEncoder(conn).Encode(&resp)
+}
+
+// ClientMain is the entire "main" for the tiny shim binary a daemon-mode
+// plugin ships alongside PluginMainServe. It reads the CNI env vars and
+// stdin from its own process, makes a single round-trip to the daemon
+// listening on socketPath, replays the daemon's stdout/stderr, and exits
+// with the code the daemon reported.
+func ClientMain(socketPath string) {
+	env := make(map[string]string, len(cniEnvVars))
+	for _, name := range cniEnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
+		}
+	}
+
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading stdin: %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to %q: %v\n", socketPath, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	req := daemonRequest{Env: env, StdinData: stdinData}
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		fmt.Fprintf(os.Stderr, "error sending request to daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		fmt.Fprintf(os.Stderr, "error reading response from daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(resp.Stdout)
+	os.Stderr.Write(resp.Stderr)
+	os.Exit(resp.ExitCode)
+}
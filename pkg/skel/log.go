@@ -0,0 +1,163 @@
+// Copyright 2014-2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is a pluggable sink for skel's per-invocation diagnostics. Debug,
+// Info, Warn, and Error each take a message followed by alternating
+// key/value pairs, so a plugin can route skel's structured log lines into
+// whatever logging library it already uses.
+type Logger interface {
+	Debug(msg string, kvs ...interface{})
+	Info(msg string, kvs ...interface{})
+	Warn(msg string, kvs ...interface{})
+	Error(msg string, kvs ...interface{})
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(s string) logLevel {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return levelDebug
+	case "WARN", "WARNING":
+		return levelWarn
+	case "ERROR":
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelWarn:
+		return "WARN"
+	case levelError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// nopLogger discards everything. It's the Logger newLoggerFromEnv returns
+// when CNI_LOG_FILE is unset or cannot be opened, and the one pluginMain
+// falls back to when no Logger is set, so a plugin that never opts into
+// logging sees no behavior change.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// envLogger is the Logger skel uses by default, configured entirely from
+// CNI_LOG_FILE and CNI_LOG_LEVEL so operators can capture per-invocation
+// diagnostics from any plugin built on this package without it having to
+// reinvent logging.
+type envLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+}
+
+// newLoggerFromEnv builds the default Logger from CNI_LOG_FILE and
+// CNI_LOG_LEVEL, as read through getenv. It returns a nopLogger if
+// CNI_LOG_FILE is unset or cannot be opened.
+func newLoggerFromEnv(getenv func(string) string) Logger {
+	logFile := getenv("CNI_LOG_FILE")
+	if logFile == "" {
+		return nopLogger{}
+	}
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nopLogger{}
+	}
+	return &envLogger{out: f, level: parseLogLevel(getenv("CNI_LOG_LEVEL"))}
+}
+
+// Close releases the underlying log file, if any. Callers that hold an
+// envLogger for longer than a single invocation (e.g. PluginMainServe) use
+// this via an io.Closer type assertion to avoid leaking the file
+// descriptor for the life of the process.
+func (l *envLogger) Close() error {
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (l *envLogger) log(level logLevel, msg string, kvs ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", time.Now().Format(time.RFC3339Nano), level, msg)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kvs[i], kvs[i+1])
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, b.String())
+}
+
+func (l *envLogger) Debug(msg string, kvs ...interface{}) { l.log(levelDebug, msg, kvs...) }
+func (l *envLogger) Info(msg string, kvs ...interface{})  { l.log(levelInfo, msg, kvs...) }
+func (l *envLogger) Warn(msg string, kvs ...interface{})  { l.log(levelWarn, msg, kvs...) }
+func (l *envLogger) Error(msg string, kvs ...interface{}) { l.log(levelError, msg, kvs...) }
+
+// requestID derives a stable identifier for an invocation from its
+// container ID, interface name and command, so separate log lines for the
+// same ADD/CHECK/DEL can be correlated without skel having to hand out its
+// own counters or UUIDs. Repeated invocations of the same command for the
+// same container and interface get the same ID.
+func requestID(cmd string, cmdArgs *CmdArgs) string {
+	return fmt.Sprintf("%s-%s-%s", cmdArgs.ContainerID, cmdArgs.IfName, cmd)
+}
+
+// peekConfigNameAndVersion best-effort extracts the network name and CNI
+// version from a plugin's stdin config, for logging purposes only.
+// Malformed or empty input (e.g. during VERSION) yields empty strings
+// rather than an error; validateConfig remains the source of truth for
+// rejecting bad configs.
+func peekConfigNameAndVersion(stdinData []byte) (name, cniVersion string) {
+	var conf struct {
+		Name       string `json:"name"`
+		CNIVersion string `json:"cniVersion"`
+	}
+	_ = json.Unmarshal(stdinData, &conf)
+	return conf.Name, conf.CNIVersion
+}
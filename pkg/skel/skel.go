@@ -24,6 +24,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime/debug"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/version"
@@ -48,6 +50,11 @@ type dispatcher struct {
 
 	ConfVersionDecoder version.ConfigDecoder
 	VersionReconciler  version.Reconciler
+
+	// Logger receives skel's per-invocation diagnostics. The PluginMain*
+	// entry points set it; when it is nil, pluginMain falls back to a no-op
+	// logger.
+	Logger Logger
 }
 
 type reqForCmdEntry map[string]bool
@@ -64,54 +71,60 @@ func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, error) {
 			"CNI_COMMAND",
 			&cmd,
 			reqForCmdEntry{
-				"ADD": true,
-				"GET": true,
-				"DEL": true,
+				"ADD":   true,
+				"GET":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 		{
 			"CNI_CONTAINERID",
 			&contID,
 			reqForCmdEntry{
-				"ADD": true,
-				"GET": true,
-				"DEL": true,
+				"ADD":   true,
+				"GET":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 		{
 			"CNI_NETNS",
 			&netns,
 			reqForCmdEntry{
-				"ADD": true,
-				"GET": true,
-				"DEL": false,
+				"ADD":   true,
+				"GET":   true,
+				"CHECK": true,
+				"DEL":   false,
 			},
 		},
 		{
 			"CNI_IFNAME",
 			&ifName,
 			reqForCmdEntry{
-				"ADD": true,
-				"GET": true,
-				"DEL": true,
+				"ADD":   true,
+				"GET":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 		{
 			"CNI_ARGS",
 			&args,
 			reqForCmdEntry{
-				"ADD": false,
-				"GET": false,
-				"DEL": false,
+				"ADD":   false,
+				"GET":   false,
+				"CHECK": false,
+				"DEL":   false,
 			},
 		},
 		{
 			"CNI_PATH",
 			&path,
 			reqForCmdEntry{
-				"ADD": true,
-				"GET": true,
-				"DEL": true,
+				"ADD":   true,
+				"GET":   true,
+				"CHECK": true,
+				"DEL":   true,
 			},
 		},
 	}
@@ -128,7 +141,10 @@ func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, error) {
 	}
 
 	if argsMissing {
-		return "", nil, fmt.Errorf("required env variables missing")
+		return "", nil, &types.Error{
+			Code: types.ErrInvalidEnvironmentVariables,
+			Msg:  "required env variables missing",
+		}
 	}
 
 	if cmd == "VERSION" {
@@ -137,7 +153,13 @@ func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, error) {
 
 	stdinData, err := ioutil.ReadAll(t.Stdin)
 	if err != nil {
-		return "", nil, fmt.Errorf("error reading from stdin: %v", err)
+		// A failure to read stdin (a broken pipe, a runtime that hasn't
+		// finished writing yet, ...) is transient rather than a permanent
+		// configuration problem, so the runtime should be able to retry it.
+		return "", nil, &types.Error{
+			Code: types.ErrTryAgainLater,
+			Msg:  fmt.Sprintf("error reading from stdin: %v", err),
+		}
 	}
 
 	cmdArgs := &CmdArgs{
@@ -158,7 +180,7 @@ func createTypedError(f string, args ...interface{}) *types.Error {
 	}
 }
 
-func (t *dispatcher) checkVersionAndCall(cmdArgs *CmdArgs, pluginVersionInfo version.PluginInfo, toCall func(*CmdArgs) error) error {
+func (t *dispatcher) checkVersionAndCall(cmdArgs *CmdArgs, pluginVersionInfo version.PluginInfo, toCall func(*CmdArgs) error) (err error) {
 	configVersion, err := t.ConfVersionDecoder.Decode(cmdArgs.StdinData)
 	if err != nil {
 		return err
@@ -172,6 +194,20 @@ func (t *dispatcher) checkVersionAndCall(cmdArgs *CmdArgs, pluginVersionInfo ver
 		}
 	}
 
+	// A panic in toCall would otherwise crash the plugin process with a raw
+	// Go stack trace on stderr, which runtimes like kubelet only see as an
+	// opaque failure. Recover it into the same spec-compliant JSON error
+	// path as any other failure.
+	defer func() {
+		if r := recover(); r != nil {
+			err = &types.Error{
+				Code:    types.ErrInternal,
+				Msg:     fmt.Sprintf("panic during plugin execution: %v", r),
+				Details: string(debug.Stack()),
+			}
+		}
+	}()
+
 	return toCall(cmdArgs)
 }
 
@@ -180,23 +216,88 @@ func validateConfig(jsonBytes []byte) error {
 		Name string `json:"name"`
 	}
 	if err := json.Unmarshal(jsonBytes, &conf); err != nil {
-		return fmt.Errorf("error reading network config: %s", err)
+		return &types.Error{
+			Code: types.ErrInvalidStdinJSON,
+			Msg:  fmt.Sprintf("error reading network config: %s", err),
+		}
 	}
 	if conf.Name == "" {
-		return fmt.Errorf("missing network name")
+		return &types.Error{
+			Code: types.ErrMissingNetworkName,
+			Msg:  "missing network name",
+		}
 	}
 	return nil
 }
 
-func (t *dispatcher) pluginMain(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) *types.Error {
+// checkVersionSupports verifies that both the network config and the plugin
+// itself support a command gated to a minimum CNI spec version (e.g. GET and
+// CHECK, which were introduced in 0.4.0), then dispatches to toCall.
+func (t *dispatcher) checkVersionSupports(cmdArgs *CmdArgs, versionInfo version.PluginInfo, minVersion, cmdName string, toCall func(*CmdArgs) error) *types.Error {
+	configVersion, err := t.ConfVersionDecoder.Decode(cmdArgs.StdinData)
+	if err != nil {
+		return createTypedError(err.Error())
+	}
+	if gtet, err := version.GreaterThanOrEqualTo(configVersion, minVersion); err != nil {
+		return createTypedError(err.Error())
+	} else if !gtet {
+		return &types.Error{
+			Code: types.ErrIncompatibleCNIVersion,
+			Msg:  fmt.Sprintf("config version does not allow %s", cmdName),
+		}
+	}
+	for _, pluginVersion := range versionInfo.SupportedVersions() {
+		gtet, err := version.GreaterThanOrEqualTo(pluginVersion, configVersion)
+		if err != nil {
+			return createTypedError(err.Error())
+		} else if gtet {
+			if err := t.checkVersionAndCall(cmdArgs, versionInfo, toCall); err != nil {
+				if e, ok := err.(*types.Error); ok {
+					return e
+				}
+				return createTypedError(err.Error())
+			}
+			return nil
+		}
+	}
+	return &types.Error{
+		Code: types.ErrIncompatibleCNIVersion,
+		Msg:  fmt.Sprintf("plugin version does not allow %s", cmdName),
+	}
+}
+
+func (t *dispatcher) pluginMain(cmdAdd, cmdGet, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) (result *types.Error) {
+	logger := t.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+
 	cmd, cmdArgs, err := t.getCmdArgsFromEnv()
 	if err != nil {
+		if e, ok := err.(*types.Error); ok {
+			return e
+		}
 		return createTypedError(err.Error())
 	}
 
+	reqID := requestID(cmd, cmdArgs)
+	configName, configVersion := peekConfigNameAndVersion(cmdArgs.StdinData)
+	start := time.Now()
+	logger.Info("invocation started", "requestID", reqID, "command", cmd, "containerID", cmdArgs.ContainerID, "netns", cmdArgs.Netns, "configName", configName, "configVersion", configVersion)
+	defer func() {
+		if result != nil {
+			logger.Error("invocation failed", "requestID", reqID, "command", cmd, "duration", time.Since(start), "error", result.Msg)
+		} else {
+			logger.Info("invocation finished", "requestID", reqID, "command", cmd, "duration", time.Since(start))
+		}
+	}()
+
 	if cmd != "VERSION" {
 		err = validateConfig(cmdArgs.StdinData)
 		if err != nil {
+			if e, ok := err.(*types.Error); ok {
+				return e
+			}
 			return createTypedError(err.Error())
 		}
 	}
@@ -205,33 +306,15 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, v
 	case "ADD":
 		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdAdd)
 	case "GET":
-		configVersion, err := t.ConfVersionDecoder.Decode(cmdArgs.StdinData)
-		if err != nil {
-			return createTypedError(err.Error())
-		}
-		if gtet, err := version.GreaterThanOrEqualTo(configVersion, "0.4.0"); err != nil {
-			return createTypedError(err.Error())
-		} else if !gtet {
-			return &types.Error{
-				Code: types.ErrIncompatibleCNIVersion,
-				Msg:  "config version does not allow GET",
-			}
+		if cmdGet == nil {
+			return createTypedError("plugin does not support GET")
 		}
-		for _, pluginVersion := range versionInfo.SupportedVersions() {
-			gtet, err := version.GreaterThanOrEqualTo(pluginVersion, configVersion)
-			if err != nil {
-				return createTypedError(err.Error())
-			} else if gtet {
-				if err := t.checkVersionAndCall(cmdArgs, versionInfo, cmdGet); err != nil {
-					return createTypedError(err.Error())
-				}
-				return nil
-			}
-		}
-		return &types.Error{
-			Code: types.ErrIncompatibleCNIVersion,
-			Msg:  "plugin version does not allow GET",
+		return t.checkVersionSupports(cmdArgs, versionInfo, "0.4.0", "GET", cmdGet)
+	case "CHECK":
+		if cmdCheck == nil {
+			return createTypedError("plugin does not support CHECK")
 		}
+		return t.checkVersionSupports(cmdArgs, versionInfo, "0.4.0", "CHECK", cmdCheck)
 	case "DEL":
 		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdDel)
 	case "VERSION":
@@ -250,6 +333,18 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, v
 	return nil
 }
 
+// PluginMainFuncs bundles the callback functions for each CNI command that
+// PluginMainWithErrorFuncs/PluginMainWithFuncs dispatch to. Passing them as
+// a struct rather than positional arguments means a future CNI verb can be
+// added as a new field here without breaking the signature of existing
+// callers.
+type PluginMainFuncs struct {
+	Add   func(_ *CmdArgs) error
+	Get   func(_ *CmdArgs) error
+	Check func(_ *CmdArgs) error
+	Del   func(_ *CmdArgs) error
+}
+
 // PluginMainWithError is the core "main" for a plugin. It accepts
 // callback functions for add, get, and del CNI commands and returns an error.
 //
@@ -262,13 +357,76 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, v
 //
 // To let this package automatically handle errors and call os.Exit(1) for you,
 // use PluginMain() instead.
+//
+// This signature is kept unchanged for source compatibility with existing
+// plugins. A plugin that implements CHECK should use
+// PluginMainWithErrorFuncs instead.
 func PluginMainWithError(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) *types.Error {
 	return (&dispatcher{
 		Getenv: os.Getenv,
 		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
-	}).pluginMain(cmdAdd, cmdGet, cmdDel, versionInfo)
+		Logger: newLoggerFromEnv(os.Getenv),
+	}).pluginMain(cmdAdd, cmdGet, nil, cmdDel, versionInfo)
+}
+
+// PluginMainWithErrorFuncs is the core "main" for a plugin that needs
+// control over more than just add/get/del, such as CHECK support or a
+// future CNI verb. It accepts a PluginMainFuncs bundling the callback
+// functions for the ADD, GET, CHECK, and DEL CNI commands and returns an
+// error.
+//
+// The caller must also specify what CNI spec versions the plugin supports.
+//
+// It is the responsibility of the caller to check for non-nil error return.
+//
+// For a plugin to comply with the CNI spec, it must print any error to stdout
+// as JSON and then exit with nonzero status code.
+//
+// To let this package automatically handle errors and call os.Exit(1) for you,
+// use PluginMainWithFuncs() instead.
+func PluginMainWithErrorFuncs(funcs PluginMainFuncs, versionInfo version.PluginInfo) *types.Error {
+	return (&dispatcher{
+		Getenv: os.Getenv,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Logger: newLoggerFromEnv(os.Getenv),
+	}).pluginMain(funcs.Add, funcs.Get, funcs.Check, funcs.Del, versionInfo)
+}
+
+// PluginMainWithLogger behaves like PluginMainWithErrorFuncs, but routes
+// skel's per-invocation diagnostics to logger instead of the CNI_LOG_FILE/
+// CNI_LOG_LEVEL-derived default. Use this when the plugin already has its
+// own structured logger and wants skel's entry/exit logging folded into it.
+func PluginMainWithLogger(funcs PluginMainFuncs, versionInfo version.PluginInfo, logger Logger) *types.Error {
+	return (&dispatcher{
+		Getenv: os.Getenv,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Logger: logger,
+	}).pluginMain(funcs.Add, funcs.Get, funcs.Check, funcs.Del, versionInfo)
+}
+
+// PluginMainWithFuncs is the core "main" for a plugin which includes
+// automatic error handling. It accepts a PluginMainFuncs so that plugins
+// which implement CHECK (or any future verb added to PluginMainFuncs) can
+// opt in without disturbing the PluginMain shim below.
+//
+// When an error occurs in any of the callbacks, PluginMainWithFuncs will
+// print the error as JSON to stdout and call os.Exit(1).
+//
+// To have more control over error handling, use PluginMainWithErrorFuncs()
+// instead.
+func PluginMainWithFuncs(funcs PluginMainFuncs, versionInfo version.PluginInfo) {
+	if e := PluginMainWithErrorFuncs(funcs, versionInfo); e != nil {
+		if err := e.Print(); err != nil {
+			log.Print("Error writing error JSON to stdout: ", err)
+		}
+		os.Exit(1)
+	}
 }
 
 // PluginMain is the core "main" for a plugin which includes automatic error handling.
@@ -278,7 +436,9 @@ func PluginMainWithError(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, versionI
 // When an error occurs in either cmdAdd, cmdGet, or cmdDel, PluginMain will print the error
 // as JSON to stdout and call os.Exit(1).
 //
-// To have more control over error handling, use PluginMainWithError() instead.
+// PluginMain does not support CHECK; a plugin that implements CHECK should
+// call PluginMainWithFuncs instead. This signature is kept unchanged for
+// source compatibility with existing plugins.
 func PluginMain(cmdAdd, cmdGet, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo) {
 	if e := PluginMainWithError(cmdAdd, cmdGet, cmdDel, versionInfo); e != nil {
 		if err := e.Print(); err != nil {
@@ -0,0 +1,33 @@
+// Copyright 2014-2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// Plugin-specific error codes carried in an Error's Code field. Error
+// itself and the CNI spec's well-known codes (ErrIncompatibleCNIVersion
+// and friends) are defined elsewhere in this package and occupy 0-7 and
+// 11; the spec reserves the rest of 1-99 for future spec use, so the
+// codes this package adds on its own must live at 100 or above. Code 100
+// itself is the generic code skel gives untyped errors, so these start at
+// 101 to stay distinguishable from it.
+const (
+	// ErrInvalidStdinJSON is returned when the network configuration piped
+	// to the plugin's stdin could not be decoded as JSON. More specific
+	// than ErrDecodingFailure for callers that want to special-case it.
+	ErrInvalidStdinJSON uint = 101 + iota
+	// ErrMissingNetworkName is returned when a network configuration is
+	// missing the "name" field the CNI spec requires. More specific than
+	// ErrInvalidNetworkConfig for callers that want to special-case it.
+	ErrMissingNetworkName
+)